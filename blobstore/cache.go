@@ -0,0 +1,148 @@
+package blobstore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cacheDir holds recently produced blobs, keyed by their SHA-256 hash, so
+// Reader can serve them without going to S3. A blob is added once
+// UploadBlob has uploaded it or CheckDuplicate has found it already
+// uploaded; blobs that Reader fetches from S3 are not added.
+// Configurable via the S3_CACHE env var.
+var cacheDir = envOrDefault("S3_CACHE", "./blob_cache")
+
+// cacheMaxBytes caps the total size of cacheDir; least-recently-used
+// entries are evicted once it's exceeded.
+const cacheMaxBytes = 1 << 30 // 1GiB
+
+// cacheMu guards concurrent writes to cacheDir so eviction doesn't race
+// with cachePut.
+var cacheMu sync.Mutex
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func cachePath(hash []byte) string {
+	return filepath.Join(cacheDir, fmt.Sprintf("%x.gz", hash))
+}
+
+// cacheGet opens the cached blob for hash, if present, touching its
+// modtime so the LRU eviction treats it as recently used.
+func cacheGet(hash []byte) (*os.File, error) {
+	path := cachePath(hash)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return f, nil
+}
+
+// cachePut adopts the file at srcPath into the cache under hash, hard
+// linking it in place so the caller can still remove its own temp file
+// without losing the cached copy. Falls back to a copy if the link fails,
+// e.g. because srcPath is on a different filesystem.
+func cachePut(hash []byte, srcPath string) error {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+
+	dst := cachePath(hash)
+	if _, err := os.Stat(dst); err == nil {
+		// already cached
+		return nil
+	}
+
+	if err := os.Link(srcPath, dst); err != nil {
+		if err := copyFile(srcPath, dst); err != nil {
+			return err
+		}
+	}
+
+	return cacheEvict()
+}
+
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// cacheEvict removes the least recently used cache entries until the
+// total cache size is back under cacheMaxBytes. Caller must hold cacheMu.
+func cacheEvict() error {
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	for _, e := range entries {
+		if total <= cacheMaxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(cacheDir, e.Name())); err != nil {
+			continue
+		}
+		total -= e.Size()
+	}
+
+	return nil
+}
+
+// PurgeCache empties the local blob cache.
+func PurgeCache() error {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		os.Remove(filepath.Join(cacheDir, e.Name()))
+	}
+
+	return nil
+}
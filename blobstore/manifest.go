@@ -0,0 +1,229 @@
+package blobstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+// manifestVersion is bumped whenever the on-disk/remote manifest JSON shape
+// changes incompatibly.
+const manifestVersion = 1
+
+// ManifestEntry describes a single file inside a directory manifest.
+type ManifestEntry struct {
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// Manifest is the content-addressed description of a directory: a list of
+// per-file blobs, each addressed by its own SHA-256 hash. Manifests are
+// themselves stored as a blob, addressed by the hash of their JSON
+// serialization, under a distinct "manifest/" prefix so Reader-style code
+// can tell manifests and regular blobs apart.
+type Manifest struct {
+	Version int             `json:"version"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// safeJoin joins dst and rel, rejecting rel if the cleaned result would
+// escape dst. Manifests are addressed purely by hash and may be produced by
+// anyone who can write to the bucket, so entry paths are untrusted input -
+// without this check a path like "../../../../home/user/.ssh/authorized_keys"
+// would let DownloadManifest write outside dst (zip-slip).
+func safeJoin(dst, rel string) (string, error) {
+	dst = filepath.Clean(dst)
+	target := filepath.Join(dst, rel)
+	if target != dst && !strings.HasPrefix(target, dst+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q escapes destination directory", rel)
+	}
+	return target, nil
+}
+
+// manifestRemoteName returns the object key a manifest is stored under.
+func manifestRemoteName(hash []byte) string {
+	return fmt.Sprintf("manifest/%x.json", hash)
+}
+
+// ReaderManifest fetches and decodes the manifest stored under hash.
+func ReaderManifest(ctx context.Context, client *minio.Client, bucket string, hash []byte) (*Manifest, error) {
+	var o *minio.Object
+	err := withRetry(ctx, retryBudgetShort, func(ctx context.Context) error {
+		var err error
+		o, err = client.GetObject(bucket, manifestRemoteName(hash), minio.GetObjectOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(o).Decode(&m); err != nil {
+		return nil, errors.Wrap(err, "Could not decode manifest")
+	}
+
+	return &m, nil
+}
+
+// uploadManifest serializes m, uploads it under manifest/<hash>.json and
+// returns its hash. Manifests are stored as plain uncompressed JSON, unlike
+// regular blobs (which are gzipped), since they're small and benefit from
+// being human readable.
+func uploadManifest(ctx context.Context, client *minio.Client, bucket string, m *Manifest) ([]byte, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not marshal manifest")
+	}
+
+	sumArr := sha256.Sum256(body)
+	sum := sumArr[:]
+	remoteFilename := manifestRemoteName(sum)
+
+	statErr := withRetry(ctx, retryBudgetShort, func(ctx context.Context) error {
+		_, err := client.StatObject(bucket, remoteFilename, minio.StatObjectOptions{})
+		return err
+	})
+	if statErr == nil {
+		// already exists, nothing to do
+		return sum, nil
+	}
+
+	err = withRetry(ctx, retryBudgetShort, func(ctx context.Context) error {
+		_, err := client.PutObject(
+			bucket,
+			remoteFilename,
+			bytes.NewReader(body),
+			int64(len(body)),
+			minio.PutObjectOptions{ContentType: "application/json"})
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not upload manifest")
+	}
+
+	return sum, nil
+}
+
+// readBlobFile fetches the blob addressed by hash and writes its
+// decompressed contents to w.
+func readBlobFile(ctx context.Context, client *minio.Client, bucket string, hash []byte, w io.Writer) error {
+	o, err := Reader(ctx, client, bucket, hash)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+
+	gzr, err := gzip.NewReader(o)
+	if err != nil {
+		return errors.Wrap(err, "Could not read blob")
+	}
+	defer gzr.Close()
+
+	_, err = ctxCopy(ctx, w, gzr)
+	return err
+}
+
+// UploadManifestDir walks src, uploading each regular file as its own
+// content-addressed blob, then uploads a manifest describing the tree and
+// returns the manifest hash. Unlike packing the whole tree into one tar blob,
+// unchanged files across uploads are skipped entirely at the S3 level
+// because each file blob is checked for a duplicate before being sent.
+func UploadManifestDir(ctx context.Context, client *minio.Client, bucket string, src string) ([]byte, error) {
+	m := &Manifest{Version: manifestVersion}
+
+	err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		blob, err := ReaderToBlob(ctx, f)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to blob %s", file)
+		}
+		defer os.Remove(blob.File.Name())
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(file, src), string(filepath.Separator))
+		blob.Reference = rel
+
+		if !CheckDuplicate(ctx, client, bucket, blob) {
+			if err := UploadBlob(ctx, client, bucket, blob); err != nil {
+				return errors.Wrapf(err, "Failed to upload %s", file)
+			}
+		}
+
+		m.Entries = append(m.Entries, ManifestEntry{
+			Path: rel,
+			Mode: uint32(fi.Mode().Perm()),
+			Size: fi.Size(),
+			Hash: fmt.Sprintf("%x", blob.Hash()),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to walk dir")
+	}
+
+	return uploadManifest(ctx, client, bucket, m)
+}
+
+// DownloadManifest fetches the manifest stored under hash and reconstructs
+// the directory tree it describes at dst.
+func DownloadManifest(ctx context.Context, client *minio.Client, bucket string, hash []byte, dst string) error {
+	m, err := ReaderManifest(ctx, client, bucket, hash)
+	if err != nil {
+		return errors.Wrap(err, "Could not fetch manifest")
+	}
+
+	for _, entry := range m.Entries {
+		target, err := safeJoin(dst, entry.Path)
+		if err != nil {
+			return errors.Wrapf(err, "Refusing to write %s", entry.Path)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return errors.Wrapf(err, "Could not create dir for %s", entry.Path)
+		}
+
+		entryHash, err := hex.DecodeString(entry.Hash)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid hash for %s", entry.Path)
+		}
+
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(entry.Mode))
+		if err != nil {
+			return errors.Wrapf(err, "Could not create %s", entry.Path)
+		}
+
+		if err := readBlobFile(ctx, client, bucket, entryHash, f); err != nil {
+			f.Close()
+			return errors.Wrapf(err, "Could not fetch %s", entry.Path)
+		}
+		f.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	minio "github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+// multipartPartSize is the size of each part sent to S3. It must stay above
+// minio's 5MiB minimum part size (except for the final part).
+const multipartPartSize = 16 << 20
+
+// BlobWriter is the interface for upload strategies that can write a blob
+// to remote storage incrementally and resume a previously interrupted
+// upload, modeled on the storage-driver FileWriter pattern.
+type BlobWriter interface {
+	Write(p []byte) (n int, err error)
+	Close() error
+	Cancel() error
+	Commit() error
+	Size() int64
+}
+
+// partState describes a single part that has already been uploaded.
+type partState struct {
+	PartNumber int    `json:"partNumber"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+}
+
+// uploadState is persisted to a local file keyed by blob hash, so a
+// MultipartBlobWriter can be resumed after the process restarts.
+type uploadState struct {
+	UploadID string      `json:"uploadId"`
+	Object   string      `json:"object"`
+	Parts    []partState `json:"parts"`
+}
+
+// uploadStateDir holds the resume state files, one per in-progress upload.
+var uploadStateDir = "./upload_state"
+
+func uploadStatePath(hash []byte) string {
+	return filepath.Join(uploadStateDir, fmt.Sprintf("%x.json", hash))
+}
+
+func loadUploadState(hash []byte) (*uploadState, error) {
+	body, err := ioutil.ReadFile(uploadStatePath(hash))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s uploadState
+	if err := json.Unmarshal(body, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *uploadState) save(hash []byte) error {
+	if err := os.MkdirAll(uploadStateDir, 0755); err != nil {
+		return err
+	}
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(uploadStatePath(hash), body, 0644)
+}
+
+func removeUploadState(hash []byte) {
+	os.Remove(uploadStatePath(hash))
+}
+
+// MultipartBlobWriter implements BlobWriter on top of S3 multipart uploads.
+// It buffers writes up to multipartPartSize before sending each part, and
+// persists the S3 UploadID plus completed part ETags to a local state file
+// so an interrupted upload can be resumed by calling NewMultipartBlobWriter
+// again for the same blob hash, instead of restarting from zero.
+type MultipartBlobWriter struct {
+	ctx    context.Context
+	core   minio.Core
+	bucket string
+	hash   []byte
+
+	state *uploadState
+	size  int64
+	buf   []byte
+}
+
+// NewMultipartBlobWriter starts (or resumes) a multipart upload for the
+// blob addressed by hash. opts is only used when starting a new upload;
+// a resumed upload keeps whatever options it was originally started with.
+// ctx is retained for the lifetime of the writer and used to bound retries
+// and allow cancellation of in-flight part uploads.
+//
+// Size() reports the number of bytes already accepted, including any
+// resumed from a previous attempt - callers streaming a source that
+// supports seeking should skip to that offset before writing, or the
+// resumed parts will be duplicated rather than continued.
+func NewMultipartBlobWriter(ctx context.Context, client *minio.Client, bucket string, hash []byte, opts minio.PutObjectOptions) (*MultipartBlobWriter, error) {
+	object := fmt.Sprintf("blob/%x.gz", hash)
+	core := minio.Core{Client: client}
+
+	state, err := loadUploadState(hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not load upload state")
+	}
+
+	if state == nil {
+		var uploadID string
+		err := withRetry(ctx, retryBudgetShort, func(ctx context.Context) error {
+			var err error
+			uploadID, err = core.NewMultipartUpload(bucket, object, opts)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not start multipart upload")
+		}
+
+		state = &uploadState{UploadID: uploadID, Object: object}
+		if err := state.save(hash); err != nil {
+			return nil, errors.Wrap(err, "Could not persist upload state")
+		}
+	}
+
+	var resumed int64
+	for _, p := range state.Parts {
+		resumed += p.Size
+	}
+
+	return &MultipartBlobWriter{
+		ctx:    ctx,
+		core:   core,
+		bucket: bucket,
+		hash:   hash,
+		state:  state,
+		size:   resumed,
+	}, nil
+}
+
+// Write buffers p, flushing completed parts to S3 as the buffer fills.
+func (w *MultipartBlobWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for len(w.buf) >= multipartPartSize {
+		if err := w.flushPart(w.buf[:multipartPartSize]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[multipartPartSize:]
+	}
+
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *MultipartBlobWriter) flushPart(data []byte) error {
+	partNumber := len(w.state.Parts) + 1
+
+	var etag string
+	err := withRetry(w.ctx, retryBudgetLong, func(ctx context.Context) error {
+		part, err := w.core.PutObjectPart(
+			w.bucket, w.state.Object, w.state.UploadID, partNumber,
+			bytes.NewReader(data), int64(len(data)), "", "", nil)
+		if err != nil {
+			return err
+		}
+		etag = part.ETag
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to upload part %d", partNumber)
+	}
+
+	w.state.Parts = append(w.state.Parts, partState{
+		PartNumber: partNumber,
+		ETag:       etag,
+		Size:       int64(len(data)),
+	})
+
+	return w.state.save(w.hash)
+}
+
+// Close flushes any buffered data as a final part. The multipart upload is
+// not completed on S3 until Commit is called.
+func (w *MultipartBlobWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	err := w.flushPart(w.buf)
+	w.buf = nil
+	return err
+}
+
+// Commit completes the multipart upload on S3 and clears the local resume
+// state.
+func (w *MultipartBlobWriter) Commit() error {
+	parts := make([]minio.CompletePart, len(w.state.Parts))
+	for i, p := range w.state.Parts {
+		parts[i] = minio.CompletePart{PartNumber: p.PartNumber, ETag: p.ETag}
+	}
+
+	err := withRetry(w.ctx, retryBudgetShort, func(ctx context.Context) error {
+		_, err := w.core.CompleteMultipartUpload(w.bucket, w.state.Object, w.state.UploadID, parts)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to complete multipart upload")
+	}
+
+	removeUploadState(w.hash)
+	return nil
+}
+
+// Cancel aborts the multipart upload on S3 and clears the local resume
+// state.
+func (w *MultipartBlobWriter) Cancel() error {
+	err := withRetry(w.ctx, retryBudgetShort, func(ctx context.Context) error {
+		return w.core.AbortMultipartUpload(w.bucket, w.state.Object, w.state.UploadID)
+	})
+	removeUploadState(w.hash)
+	return err
+}
+
+// Size returns the number of bytes written so far, including bytes
+// resumed from a previous attempt.
+func (w *MultipartBlobWriter) Size() int64 {
+	return w.size
+}
@@ -0,0 +1,108 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Default elapsed-time budgets passed to withRetry.
+const (
+	retryBudgetShort = 1 * time.Minute // single metadata-ish S3 calls
+	retryBudgetLong  = 2 * time.Hour   // full blob uploads/downloads
+)
+
+const (
+	retryInitialBackoff = 500 * time.Millisecond
+	retryMaxBackoff     = 30 * time.Second
+)
+
+// withRetry runs op with exponential backoff and jitter, retrying only on
+// transient errors (5xx responses, network errors, timeouts). It gives up
+// once budget has elapsed since the first attempt, once op returns a
+// non-retryable error, or once ctx is canceled - so a client disconnect or
+// server shutdown aborts in-flight work promptly instead of retrying it.
+func withRetry(ctx context.Context, budget time.Duration, op func(context.Context) error) error {
+	deadline := time.Now().Add(budget)
+	backoff := retryInitialBackoff
+
+	for {
+		err := op(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if !isRetryable(err) || time.Now().After(deadline) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// jitter returns a random duration between d/2 and d, to avoid
+// thundering-herd retries.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2+1)))
+}
+
+// isRetryable reports whether err looks like a transient S3 or network
+// failure worth retrying, as opposed to e.g. a missing object or bad
+// credentials.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errResp := minio.ToErrorResponse(err); errResp.Code != "" {
+		switch errResp.StatusCode {
+		case 500, 502, 503, 504:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+
+	return false
+}
+
+// ctxReader wraps src so a Read returns ctx.Err() once ctx is canceled,
+// instead of reading (and forwarding) more data.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	select {
+	case <-cr.ctx.Done():
+		return 0, cr.ctx.Err()
+	default:
+	}
+	return cr.r.Read(p)
+}
+
+// ctxCopy is like io.Copy but checks ctx before every chunk read from src,
+// so a canceled ctx stops the copy after at most one in-flight chunk
+// instead of leaving an unbounded goroutine writing to dst in the
+// background after the caller has moved on.
+func ctxCopy(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, ctxReader{ctx: ctx, r: src})
+}
@@ -0,0 +1,164 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	minio "github.com/minio/minio-go"
+	"github.com/pkg/errors"
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// Reader returns a reader for the blob addressed by hash, consulting the
+// local cache before falling back to S3.
+func Reader(ctx context.Context, client *minio.Client, bucket string, hash []byte) (io.ReadCloser, error) {
+	if f, err := cacheGet(hash); err == nil {
+		return f, nil
+	}
+
+	var o *minio.Object
+	err := withRetry(ctx, retryBudgetShort, func(ctx context.Context) error {
+		var err error
+		o, err = client.GetObject(bucket, fmt.Sprintf("blob/%x.gz", hash), minio.GetObjectOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ReaderToBlob compresses and hashes fr into a new LocalBlob.
+func ReaderToBlob(ctx context.Context, fr io.Reader) (blob *LocalBlob, e error) {
+
+	blob, err := NewLocalBlob()
+	if err != nil {
+		blob.Close()
+		os.Remove(blob.File.Name()) // try to clean up
+		return nil, errors.Wrap(err, "Could not create blob")
+	}
+	defer blob.Close()
+
+	// copy file reader into the chain
+	_, err = ctxCopy(ctx, blob, fr)
+	if err != nil {
+		os.Remove(blob.File.Name()) // try to clean up
+		return nil, errors.Wrap(err, "Error while processing")
+	}
+
+	blob.Close() // flush all remaining bytes
+
+	return blob, nil
+}
+
+// CheckDuplicate return true if a duplicate exists
+func CheckDuplicate(ctx context.Context, client *minio.Client, bucket string, blob *LocalBlob) bool {
+	remoteFilename := fmt.Sprintf("blob/%x.gz", blob.Hash())
+
+	var info minio.ObjectInfo
+	err := withRetry(ctx, retryBudgetShort, func(ctx context.Context) error {
+		o, err := client.GetObject(bucket, remoteFilename, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		info, err = o.Stat()
+		return err
+	})
+	if err != nil {
+		return false
+	}
+
+	if blob.Size() != info.Size {
+		// size does not match
+		return false
+	}
+
+	// found - cache it locally too, since the caller just compressed and
+	// hashed the whole thing and will otherwise discard it without ever
+	// populating the cache for the next Reader call on this hash.
+	if err := cachePut(blob.Hash(), blob.File.Name()); err != nil {
+		log.Printf("cache: could not store blob %x: %s", blob.Hash(), err)
+	}
+
+	return true
+}
+
+// UploadBlob uploads blob via a BlobWriter backed by S3 multipart uploads,
+// so an upload interrupted partway through can be resumed by calling
+// UploadBlob again for the same blob (the in-progress parts are picked up
+// from the local resume state instead of being re-sent).
+func UploadBlob(ctx context.Context, client *minio.Client, bucket string, blob *LocalBlob) error {
+	bar := pb.New64(blob.Size())
+	bar.ShowSpeed = true
+	bar.ShowElapsedTime = true
+	bar.ShowTimeLeft = true
+	bar.Units = pb.U_BYTES
+	bar.ShowFinalTime = true
+	bar.Start()
+	defer bar.Finish()
+
+	w, err := NewMultipartBlobWriter(ctx, client, bucket, blob.Hash(), minio.PutObjectOptions{
+		ContentType: "application/gzip",
+		UserMetadata: map[string]string{
+			"Uncompressed-Size": strconv.FormatInt(blob.UncompressedSize(), 10),
+			"Reference-Name":    blob.Reference,
+			"Is-Dir":            strconv.FormatBool(blob.IsDir),
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Error while uploading blob")
+	}
+
+	f, err := os.Open(blob.File.Name())
+	if err != nil {
+		w.Cancel()
+		return errors.Wrap(err, "Error while uploading blob")
+	}
+	defer f.Close()
+
+	// Resume from where a previous attempt left off: w.Size() already
+	// accounts for parts restored from the local upload state, so the
+	// source must be skipped forward to match, or those bytes would be
+	// re-sent as new, duplicate trailing parts.
+	if resumed := w.Size(); resumed > 0 {
+		if _, err := f.Seek(resumed, io.SeekStart); err != nil {
+			w.Cancel()
+			return errors.Wrap(err, "Error while uploading blob")
+		}
+		bar.Set64(resumed)
+	}
+
+	// A canceled ctx or a transient failure that outlasted the retry budget
+	// keeps the upload state, so the next UploadBlob call resumes it; any
+	// other error aborts the upload.
+	abort := func(err error) {
+		if ctx.Err() == nil && !isRetryable(errors.Cause(err)) {
+			w.Cancel()
+		}
+	}
+
+	if _, err := ctxCopy(ctx, w, bar.NewProxyReader(f)); err != nil {
+		abort(err)
+		return errors.Wrap(err, "Error while uploading blob")
+	}
+	bar.Set64(w.Size())
+
+	if err := w.Close(); err != nil {
+		abort(err)
+		return errors.Wrap(err, "Error while uploading blob")
+	}
+
+	if err := w.Commit(); err != nil {
+		return errors.Wrap(err, "Error while uploading blob")
+	}
+
+	if err := cachePut(blob.Hash(), blob.File.Name()); err != nil {
+		log.Printf("cache: could not store blob %x: %s", blob.Hash(), err)
+	}
+
+	return nil
+}
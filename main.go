@@ -4,9 +4,8 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
-	"crypto/sha256"
+	"context"
 	"fmt"
-	"hash"
 	"html/template"
 	"io"
 	"io/ioutil"
@@ -14,16 +13,16 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/miolini/datacounter"
-	pb "gopkg.in/cheggaaa/pb.v1"
-
 	"github.com/go-chi/chi"
 	minio "github.com/minio/minio-go"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/grunions/poc-spaces-upload/blobstore"
+	sftpfrontend "github.com/grunions/poc-spaces-upload/sftp"
 )
 
 type Package interface {
@@ -83,182 +82,10 @@ func init() {
 
 }
 
-// LocalBlob is a gzip compressed object, which may either be a single file
-// or a directory in a tar file
-type LocalBlob struct {
-	IsDir     bool
-	Reference string
-	// Size()
-	// UncompressedSize()
-	// Hash()
-
-	File *os.File
-
-	pw *pb.ProgressBar
-
-	gw  io.WriteCloser             // gzip writer for compression
-	hw  hash.Hash                  // hashwriter for checksum
-	ccw *datacounter.WriterCounter // countWriter for counting written compressed bytes
-	ucw *datacounter.WriterCounter // countWriter for counting written uncompressed bytes
-	mw  io.Writer                  // multiWriter for combining hash and gzip
-
-	// A human readable reference, for example a filename associated with the
-	// blob, e.g. "Human Music.mp3". This is non-unique, user-controlled and
-	// must not be used for any logic.
-}
-
-// NewLocalBlob creates a new blob with a temporary file, which MUST be
-// deleted after all related actions are complete.
-func NewLocalBlob() (*LocalBlob, error) {
-	blob := &LocalBlob{
-		IsDir: false,
-	}
-
-	var err error
-
-	blob.File, err = ioutil.TempFile("", "blob")
-	if err != nil {
-		return nil, errors.Wrap(err, "Blob: could not create temporary file")
-	}
-
-	// progress bar
-	blob.pw = pb.New(0)
-	blob.pw.SetUnits(pb.U_BYTES)
-	blob.pw.ShowSpeed = true
-	blob.pw.ShowPercent = false
-	blob.pw.ShowTimeLeft = false
-	blob.pw.ShowBar = false
-	blob.pw.Start()
-
-	blob.ccw = datacounter.NewWriterCounter(blob.File)
-	blob.gw, _ = gzip.NewWriterLevel(blob.ccw, gzip.BestCompression)
-	blob.ucw = datacounter.NewWriterCounter(blob.gw)
-	blob.hw = sha256.New()
-	blob.mw = io.MultiWriter(blob.ucw, blob.hw, blob.pw)
-
-	return blob, nil
-}
-
-// Close finishes the writing process to the blob
-func (blob *LocalBlob) Close() error {
-	blob.pw.Finish()
-	blob.gw.Close()
-	return blob.File.Close()
-}
-
-// Size returns the Compressed blob size
-func (blob *LocalBlob) Size() int64 {
-	return int64(blob.ccw.Count())
-}
-
-// UncompressedSize returns the original size, or the size of the
-// Tar file if the blob is a dir blob
-func (blob *LocalBlob) UncompressedSize() int64 {
-	return int64(blob.ucw.Count())
-}
-
-// Hash returns the checksum of the uncompressed data
-func (blob *LocalBlob) Hash() []byte {
-	return blob.hw.Sum(nil)
-}
-
-// Write implements the standard Write interface
-func (blob *LocalBlob) Write(b []byte) (n int, err error) {
-	return blob.mw.Write(b)
-}
-
 func index(w http.ResponseWriter, req *http.Request) {
 	tpl.ExecuteTemplate(w, "upload.html", nil)
 }
 
-func Reader(client *minio.Client, hash []byte) (io.ReadCloser, error) {
-	o, err := client.GetObject(config.S3.Bucket, fmt.Sprintf("blob/%x.gz", hash), minio.GetObjectOptions{})
-	if err != nil {
-		return nil, err
-	}
-	return o, nil
-}
-
-func ReaderToBlob(fr io.Reader) (blob *LocalBlob, e error) {
-
-	blob, err := NewLocalBlob()
-	if err != nil {
-		blob.Close()
-		os.Remove(blob.File.Name()) // try to clean up
-		return nil, errors.Wrap(err, "Could not create blob")
-	}
-	defer blob.Close()
-
-	// copy file reader into the chain
-	_, err = io.Copy(blob, fr)
-	if err != nil {
-		os.Remove(blob.File.Name()) // try to clean up
-		return nil, errors.Wrap(err, "Error while processing")
-	}
-
-	blob.Close() // flush all remaining bytes
-
-	return blob, nil
-}
-
-// CheckDuplicate return true if a duplicate exists
-func CheckDuplicate(client *minio.Client, blob *LocalBlob) bool {
-	remoteFilename := fmt.Sprintf("blob/%x.gz", blob.Hash())
-	o, err := client.GetObject(config.S3.Bucket, remoteFilename, minio.GetObjectOptions{})
-	if err != nil {
-		return false
-
-	}
-
-	var info minio.ObjectInfo
-	if info, err = o.Stat(); err != nil {
-		return false
-	}
-
-	if blob.Size() != info.Size {
-		// size does not match
-		return false
-	}
-
-	// found
-	return true
-}
-
-func UploadBlob(client *minio.Client, blob *LocalBlob) error {
-	remoteFilename := fmt.Sprintf("blob/%x.gz", blob.Hash())
-
-	bar := pb.New64(blob.Size())
-	bar.ShowSpeed = true
-	bar.ShowElapsedTime = true
-	bar.ShowTimeLeft = true
-	bar.Units = pb.U_BYTES
-	bar.ShowFinalTime = true
-	bar.Start()
-	defer bar.Finish()
-
-	written, err := client.FPutObject(
-		config.S3.Bucket,
-		remoteFilename,
-		blob.File.Name(),
-		minio.PutObjectOptions{
-			Progress:    bar,
-			ContentType: "application/gzip",
-			UserMetadata: map[string]string{
-				"Uncompressed-Size": strconv.FormatInt(blob.UncompressedSize(), 10),
-				"Reference-Name":    blob.Reference,
-				"Is-Dir":            strconv.FormatBool(blob.IsDir),
-			},
-		})
-	bar.Set64(written)
-	if err != nil {
-		// try to remove
-		client.RemoveObject(config.S3.Bucket, remoteFilename)
-		return errors.Wrap(err, "Error while uploading blob")
-	}
-
-	return nil
-}
-
 func TarDir(src string, writer io.Writer) error {
 	// ensure the src actually exists before trying to tar it
 	if _, err := os.Stat(src); err != nil {
@@ -430,9 +257,10 @@ func TarZip(reader io.ReaderAt, size int64, writer io.Writer) error {
 			return err
 		}
 
-		// return on non-regular files)
+		// skip non-regular entries (e.g. directories); their header has
+		// already been written above
 		if !fi.Mode().IsRegular() {
-			return nil
+			continue
 		}
 
 		// open files for taring
@@ -454,32 +282,12 @@ func TarZip(reader io.ReaderAt, size int64, writer io.Writer) error {
 	return tw.Close()
 }
 
-func UploadDir(client *minio.Client, src string) ([]byte, error) {
-	blob, err := NewLocalBlob()
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to prepare dir blob")
-	}
-	blob.IsDir = true
-	defer os.Remove(blob.File.Name())
-	defer blob.Close()
-
-	if err := TarDir(src, blob); err != nil {
-		return nil, errors.Wrap(err, "Failed to tar dir")
-	}
-	if err := blob.Close(); err != nil {
-		return nil, errors.Wrap(err, "Failed to flush blob dir")
-	}
-
-	if CheckDuplicate(client, blob) {
-		// already exists, exit early
-		return blob.Hash(), nil
-	}
-
-	if err := UploadBlob(client, blob); err != nil {
-		return blob.Hash(), errors.Wrap(err, "Failed to upload dir")
-	}
-
-	return blob.Hash(), nil
+// UploadDir uploads src as a content-addressed manifest: every regular file
+// becomes its own deduplicated blob, and the returned hash addresses the
+// manifest describing the tree (see blobstore.Manifest), not a single tar
+// blob.
+func UploadDir(ctx context.Context, client *minio.Client, src string) ([]byte, error) {
+	return blobstore.UploadManifestDir(ctx, client, config.S3.Bucket, src)
 }
 
 // example for uploading a local directory
@@ -502,7 +310,7 @@ func xupl(w http.ResponseWriter, r *http.Request) {
 		f.Flush()
 	}
 
-	checksum, err := UploadDir(client, src)
+	checksum, err := UploadDir(r.Context(), client, src)
 	if err != nil {
 		fmt.Fprintln(w, "Failed uploading dir")
 		log.Printf("Error: %s", err)
@@ -543,7 +351,7 @@ func directoryUpload(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	blob, err := NewLocalBlob()
+	blob, err := blobstore.NewLocalBlob()
 	if err != nil {
 		fmt.Fprintln(w, "error opening archive")
 		log.Printf("error creating blob: %s", err)
@@ -589,7 +397,7 @@ func directoryUpload(w http.ResponseWriter, req *http.Request) {
 	tw.Close() // flush remaining bytes
 	blob.Close()
 
-	if err := UploadBlob(client, blob); err != nil {
+	if err := blobstore.UploadBlob(req.Context(), client, config.S3.Bucket, blob); err != nil {
 		panic(err)
 	}
 
@@ -637,7 +445,7 @@ func multiUpload(w http.ResponseWriter, req *http.Request) {
 		}
 		defer fr.Close()
 
-		blob, err := ReaderToBlob(fr)
+		blob, err := blobstore.ReaderToBlob(req.Context(), fr)
 		if err != nil {
 			fmt.Fprintln(w, "Error")
 			log.Printf("Error: %s", err)
@@ -648,13 +456,13 @@ func multiUpload(w http.ResponseWriter, req *http.Request) {
 		// set optional reference
 		blob.Reference = file.Filename
 
-		if CheckDuplicate(client, blob) {
+		if blobstore.CheckDuplicate(req.Context(), client, config.S3.Bucket, blob) {
 			// file was already uploaded
 			fmt.Fprintf(w, "replaced %10d byte: %s\n", blob.UncompressedSize(), file.Filename)
 			continue
 		}
 
-		err = UploadBlob(client, blob)
+		err = blobstore.UploadBlob(req.Context(), client, config.S3.Bucket, blob)
 		if err != nil {
 			fmt.Fprintln(w, "Error")
 			log.Printf("Error: %s", err)
@@ -667,11 +475,115 @@ func multiUpload(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// maybeServeSFTP starts the SFTP frontend in the background when
+// SFTP_ADDR and SFTP_HOST_KEY are configured, sharing config.S3 with the
+// HTTP server. It is a no-op otherwise.
+func maybeServeSFTP() {
+	addr := os.Getenv("SFTP_ADDR")
+	hostKeyPath := os.Getenv("SFTP_HOST_KEY")
+	if addr == "" || hostKeyPath == "" {
+		return
+	}
+
+	keyBytes, err := ioutil.ReadFile(hostKeyPath)
+	if err != nil {
+		log.Fatalf("sftp: could not read host key: %s", err)
+	}
+	hostKey, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		log.Fatalf("sftp: could not parse host key: %s", err)
+	}
+
+	srv, err := sftpfrontend.New(sftpfrontend.Config{
+		S3: sftpfrontend.S3Config{
+			Key:      config.S3.Key,
+			Secret:   config.S3.Secret,
+			Location: config.S3.Location,
+			Bucket:   config.S3.Bucket,
+			Endpoint: config.S3.Endpoint,
+			SSL:      config.S3.SSL,
+		},
+		HostKey: hostKey,
+		Auth: &sftpfrontend.PublicKeyFileAuthenticator{
+			AuthorizedKeysPath: os.Getenv("SFTP_AUTHORIZED_KEYS"),
+		},
+	})
+	if err != nil {
+		log.Fatalf("sftp: could not start server: %s", err)
+	}
+
+	go func() {
+		log.Printf("sftp: listening on %s", addr)
+		log.Fatalf("sftp: %s", srv.ListenAndServe(addr))
+	}()
+}
+
+// uploadZip accepts a raw zip body (no multipart encoding), streaming it
+// into a single dir-blob via ZipUploadToBlob, so clients can e.g.
+// `zip -r - . | curl --data-binary @- .../upload-zip` without holding the
+// whole archive in memory or using multipart form encoding.
+func uploadZip(w http.ResponseWriter, req *http.Request) {
+	client, err := minio.New(
+		config.S3.Endpoint,
+		config.S3.Key,
+		config.S3.Secret,
+		config.S3.SSL)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		fmt.Fprintf(w, "Error\n")
+		return
+	}
+
+	blob, err := blobstore.NewLocalBlob()
+	if err != nil {
+		fmt.Fprintln(w, "error creating blob")
+		log.Printf("error creating blob: %s", err)
+		return
+	}
+	blob.IsDir = true
+	defer os.Remove(blob.File.Name())
+	defer blob.Close()
+
+	if err := ZipUploadToBlob(req.Body, blob); err != nil {
+		fmt.Fprintln(w, "Error")
+		log.Printf("Error: %s", err)
+		return
+	}
+	blob.Close() // flush remaining bytes
+
+	if blobstore.CheckDuplicate(req.Context(), client, config.S3.Bucket, blob) {
+		fmt.Fprintf(w, "replaced %10d byte dir\n", blob.UncompressedSize())
+		return
+	}
+
+	if err := blobstore.UploadBlob(req.Context(), client, config.S3.Bucket, blob); err != nil {
+		fmt.Fprintln(w, "Error")
+		log.Printf("Error: %s", err)
+		return
+	}
+
+	fmt.Fprintf(w, "Uploaded dir with checksum %x\n", blob.Hash())
+}
+
+// CachePurge empties the local blob cache.
+func CachePurge(w http.ResponseWriter, req *http.Request) {
+	if err := blobstore.PurgeCache(); err != nil {
+		fmt.Fprintln(w, "Error")
+		log.Printf("Error: %s", err)
+		return
+	}
+	fmt.Fprintln(w, "Cache purged")
+}
+
 func main() {
+	maybeServeSFTP()
+
 	router := chi.NewMux()
 	router.Get("/", index)
 	router.Get("/x", xupl)
 	router.Post("/upload-dir", directoryUpload)
 	router.Post("/upload-files", multiUpload)
+	router.Post("/upload-zip", uploadZip)
+	router.Post("/cache-purge", CachePurge)
 	http.ListenAndServe(":8000", router)
 }
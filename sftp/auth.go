@@ -0,0 +1,72 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Authenticator is implemented by anything that can be plugged into a
+// Server's Config to validate incoming connections. It is deliberately
+// empty: concrete authentication happens via the narrower
+// PublicKeyAuthenticator/PasswordAuthenticator interfaces below, and a
+// single Authenticator value may implement either or both.
+type Authenticator interface{}
+
+// PublicKeyAuthenticator validates an incoming SFTP connection by public
+// key.
+type PublicKeyAuthenticator interface {
+	Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+}
+
+// PasswordAuthenticator validates an incoming SFTP connection by
+// username/password, e.g. against an LDAP bind.
+type PasswordAuthenticator interface {
+	AuthenticatePassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error)
+}
+
+// PublicKeyFileAuthenticator authenticates against a static
+// authorized_keys-formatted file, re-read on every connection attempt so
+// the file can be edited without restarting the server.
+type PublicKeyFileAuthenticator struct {
+	AuthorizedKeysPath string
+}
+
+// Authenticate implements PublicKeyAuthenticator.
+func (a *PublicKeyFileAuthenticator) Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	body, err := ioutil.ReadFile(a.AuthorizedKeysPath)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: could not read authorized keys: %s", err)
+	}
+
+	for len(body) > 0 {
+		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(body)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(pubKey.Marshal(), key.Marshal()) {
+			return &ssh.Permissions{Extensions: map[string]string{"user": conn.User()}}, nil
+		}
+		body = rest
+	}
+
+	return nil, fmt.Errorf("sftp: unknown public key for user %q", conn.User())
+}
+
+// LDAPAuthenticator authenticates password logins via an LDAP bind. The
+// bind itself is delegated to BindFunc so this package doesn't need to
+// depend on a particular LDAP client library - callers wire up whichever
+// one they already use.
+type LDAPAuthenticator struct {
+	BindFunc func(user, password string) error
+}
+
+// AuthenticatePassword authenticates a password-based SFTP login.
+func (a *LDAPAuthenticator) AuthenticatePassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if err := a.BindFunc(conn.User(), string(password)); err != nil {
+		return nil, fmt.Errorf("sftp: LDAP bind failed for user %q: %s", conn.User(), err)
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"user": conn.User()}}, nil
+}
@@ -0,0 +1,35 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// namedFile is a minimal os.FileInfo for directory listings - the blob
+// store doesn't track mtimes or permissions beyond what's already in a
+// manifest, so most fields are left at their zero value.
+type namedFile string
+
+func (n namedFile) Name() string       { return string(n) }
+func (n namedFile) Size() int64        { return 0 }
+func (n namedFile) Mode() os.FileMode  { return 0444 }
+func (n namedFile) ModTime() time.Time { return time.Time{} }
+func (n namedFile) IsDir() bool        { return false }
+func (n namedFile) Sys() interface{}   { return nil }
+
+// listerAt implements github.com/pkg/sftp.ListerAt over a plain slice of
+// os.FileInfo, the way the package's own examples do.
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
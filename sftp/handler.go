@@ -0,0 +1,237 @@
+package sftp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+	"github.com/pkg/errors"
+	gosftp "github.com/pkg/sftp"
+
+	"github.com/grunions/poc-spaces-upload/blobstore"
+)
+
+// blobFS implements github.com/pkg/sftp's request handlers on top of the
+// blobstore package, translating SFTP paths into blob/manifest reads and
+// writes, so SFTP uploads/downloads flow through the same
+// compression/hashing/dedup/retry/cache/resume logic as the HTTP handlers:
+//
+//	/blob/<hex>            a single content-addressed blob
+//	/manifest/<hex>/<path> a file inside a directory manifest
+type blobFS struct {
+	client *minio.Client
+	bucket string
+}
+
+func newBlobFS(client *minio.Client, bucket string) *blobFS {
+	return &blobFS{client: client, bucket: bucket}
+}
+
+// parsePath splits an SFTP path into its addressed hash and, for manifest
+// paths, the file within the manifest.
+func parsePath(p string) (hash, rel string, isManifest bool, err error) {
+	p = strings.TrimPrefix(p, "/")
+	parts := strings.SplitN(p, "/", 3)
+
+	switch parts[0] {
+	case "blob":
+		if len(parts) < 2 || parts[1] == "" {
+			return "", "", false, os.ErrNotExist
+		}
+		return parts[1], "", false, nil
+	case "manifest":
+		if len(parts) < 2 || parts[1] == "" {
+			return "", "", true, os.ErrNotExist
+		}
+		if len(parts) == 3 {
+			rel = parts[2]
+		}
+		return parts[1], rel, true, nil
+	default:
+		return "", "", false, os.ErrNotExist
+	}
+}
+
+func (fs *blobFS) fetchManifest(ctx context.Context, hash string) (*blobstore.Manifest, error) {
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: invalid manifest hash")
+	}
+
+	return blobstore.ReaderManifest(ctx, fs.client, fs.bucket, h)
+}
+
+func (fs *blobFS) readBlob(ctx context.Context, hash string) (io.ReaderAt, error) {
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: invalid blob hash")
+	}
+
+	o, err := blobstore.Reader(ctx, fs.client, fs.bucket, h)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+
+	// blobs are stored gzipped; serve the original bytes that were put
+	gzr, err := gzip.NewReader(o)
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: could not read blob")
+	}
+	defer gzr.Close()
+
+	body, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: could not read blob")
+	}
+
+	return bytes.NewReader(body), nil
+}
+
+func (fs *blobFS) readManifestFile(ctx context.Context, hash, rel string) (io.ReaderAt, error) {
+	m, err := fs.fetchManifest(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range m.Entries {
+		if entry.Path == rel {
+			return fs.readBlob(ctx, entry.Hash)
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// Fileread implements github.com/pkg/sftp.FileReader.
+func (fs *blobFS) Fileread(r *gosftp.Request) (io.ReaderAt, error) {
+	hash, rel, isManifest, err := parsePath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if !isManifest {
+		return fs.readBlob(r.Context(), hash)
+	}
+	return fs.readManifestFile(r.Context(), hash, rel)
+}
+
+// Filewrite implements github.com/pkg/sftp.FileWriter. Only writes under
+// /blob/<hex> are accepted - manifests are produced by the HTTP/directory
+// upload path, not written to directly.
+func (fs *blobFS) Filewrite(r *gosftp.Request) (io.WriterAt, error) {
+	_, _, isManifest, err := parsePath(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if isManifest {
+		return nil, errors.New("sftp: writing into a manifest is not supported, put to /blob/<hex> instead")
+	}
+
+	return newBlobWriter(r.Context(), fs.client, fs.bucket)
+}
+
+// blobWriter buffers an incoming write to a temp file, then on Close builds
+// a blobstore.LocalBlob from it and uploads it through UploadBlob, so SFTP
+// puts dedup, retry and resume exactly like the HTTP upload handlers (the
+// hex in the SFTP path is advisory only, matching how a client picks the
+// upload destination before it knows the final hash).
+type blobWriter struct {
+	ctx    context.Context
+	client *minio.Client
+	bucket string
+
+	tmp *os.File
+}
+
+func newBlobWriter(ctx context.Context, client *minio.Client, bucket string) (*blobWriter, error) {
+	tmp, err := ioutil.TempFile("", "sftp-blob")
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: could not create temp file")
+	}
+
+	return &blobWriter{ctx: ctx, client: client, bucket: bucket, tmp: tmp}, nil
+}
+
+func (w *blobWriter) WriteAt(p []byte, off int64) (int, error) {
+	return w.tmp.WriteAt(p, off)
+}
+
+// Close builds a LocalBlob from the buffered write and uploads it, deduping
+// against any existing blob with the same hash first.
+func (w *blobWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "sftp: could not rewind temp file")
+	}
+
+	blob, err := blobstore.ReaderToBlob(w.ctx, w.tmp)
+	if err != nil {
+		return errors.Wrap(err, "sftp: could not process blob")
+	}
+	defer os.Remove(blob.File.Name())
+
+	if blobstore.CheckDuplicate(w.ctx, w.client, w.bucket, blob) {
+		return nil
+	}
+
+	if err := blobstore.UploadBlob(w.ctx, w.client, w.bucket, blob); err != nil {
+		return errors.Wrap(err, "sftp: could not upload blob")
+	}
+
+	return nil
+}
+
+// Filelist implements github.com/pkg/sftp.FileLister.
+func (fs *blobFS) Filelist(r *gosftp.Request) (gosftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		if r.Filepath == "/" {
+			return listerAt{namedFile("blob"), namedFile("manifest")}, nil
+		}
+
+		hash, rel, isManifest, err := parsePath(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		if !isManifest {
+			return listerAt{namedFile(hash)}, nil
+		}
+
+		m, err := fs.fetchManifest(r.Context(), hash)
+		if err != nil {
+			return nil, err
+		}
+
+		var out listerAt
+		for _, entry := range m.Entries {
+			if rel == "" || strings.HasPrefix(entry.Path, rel) {
+				out = append(out, namedFile(entry.Path))
+			}
+		}
+		return out, nil
+
+	case "Stat":
+		_, _, _, err := parsePath(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{namedFile(r.Filepath)}, nil
+	}
+
+	return nil, gosftp.ErrSSHFxOpUnsupported
+}
+
+// Filecmd implements github.com/pkg/sftp.FileCmder. The store is
+// content-addressed and immutable, so renames/removes/mkdirs are not
+// supported.
+func (fs *blobFS) Filecmd(r *gosftp.Request) error {
+	return gosftp.ErrSSHFxOpUnsupported
+}
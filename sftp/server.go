@@ -0,0 +1,159 @@
+// Package sftp runs an SSH/SFTP frontend for the content-addressed blob
+// store, so non-browser clients can `sftp put`/`get` blobs and manifests
+// over SSH instead of going through the HTTP handlers. Uploads and
+// downloads flow through the same blobstore package as the HTTP server,
+// keyed by the same bucket.
+package sftp
+
+import (
+	"io"
+	"log"
+	"net"
+
+	minio "github.com/minio/minio-go"
+	"github.com/pkg/errors"
+	gosftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// S3Config mirrors the root package's S3Config; callers pass through their
+// existing config.S3 so the SFTP frontend shares credentials and bucket
+// with the HTTP server.
+type S3Config struct {
+	Key      string
+	Secret   string
+	Location string
+	Bucket   string
+	Endpoint string
+	SSL      bool
+}
+
+// Config configures a Server.
+type Config struct {
+	S3 S3Config
+
+	// HostKey is the server's private key, used to identify itself to
+	// connecting clients.
+	HostKey ssh.Signer
+
+	// Auth authenticates incoming connections. See PublicKeyFileAuthenticator
+	// and LDAPAuthenticator.
+	Auth Authenticator
+}
+
+// Server is an SFTP frontend backed by the blob store.
+type Server struct {
+	config Config
+	client *minio.Client
+	ssh    *ssh.ServerConfig
+}
+
+// New constructs a Server from cfg. It does not start listening.
+func New(cfg Config) (*Server, error) {
+	client, err := minio.New(cfg.S3.Endpoint, cfg.S3.Key, cfg.S3.Secret, cfg.S3.SSL)
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: could not create S3 client")
+	}
+
+	sshConfig := &ssh.ServerConfig{}
+
+	if pk, ok := cfg.Auth.(PublicKeyAuthenticator); ok {
+		sshConfig.PublicKeyCallback = pk.Authenticate
+	}
+	if pw, ok := cfg.Auth.(PasswordAuthenticator); ok {
+		sshConfig.PasswordCallback = pw.AuthenticatePassword
+	}
+	if sshConfig.PublicKeyCallback == nil && sshConfig.PasswordCallback == nil {
+		return nil, errors.New("sftp: no authenticator configured")
+	}
+
+	sshConfig.AddHostKey(cfg.HostKey)
+
+	return &Server{config: cfg, client: client, ssh: sshConfig}, nil
+}
+
+// ListenAndServe accepts connections on addr until the listener errors.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "sftp: could not listen")
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.ssh)
+	if err != nil {
+		log.Printf("sftp: handshake failed: %s", err)
+		return
+	}
+	defer sconn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("sftp: could not accept channel: %s", err)
+			continue
+		}
+
+		go s.handleSession(channel, requests)
+	}
+}
+
+func (s *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	// requests arrive straight off the wire; a malformed one must not take
+	// down every other in-flight session.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("sftp: recovered from panic handling session: %v", r)
+		}
+	}()
+
+	for req := range requests {
+		ok := req.Type == "subsystem" && len(req.Payload) >= 4 && string(req.Payload[4:]) == "sftp"
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if !ok {
+			continue
+		}
+
+		s.serveSFTP(channel)
+		return
+	}
+}
+
+func (s *Server) serveSFTP(rw io.ReadWriteCloser) {
+	fs := newBlobFS(s.client, s.config.S3.Bucket)
+
+	handlers := gosftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	}
+
+	srv := gosftp.NewRequestServer(rw, handlers)
+	defer srv.Close()
+
+	if err := srv.Serve(); err != nil && err != io.EOF {
+		log.Printf("sftp: session ended: %s", err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/grunions/poc-spaces-upload/blobstore"
+)
+
+// ZipUploadToBlob streams r, a raw zip archive, into blob as a tar without
+// requiring the caller to buffer the whole upload in memory first. The
+// incoming archive is spooled to a temp file only because zip's central
+// directory lives at the end and needs random access to read it; entries
+// are then streamed through tar.Writer straight into blob in constant
+// memory. The spool file is removed before ZipUploadToBlob returns.
+func ZipUploadToBlob(r io.Reader, blob *blobstore.LocalBlob) error {
+	spool, err := ioutil.TempFile("", "zip-spool")
+	if err != nil {
+		return errors.Wrap(err, "Could not create spool file")
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return errors.Wrap(err, "Could not spool zip upload")
+	}
+
+	if err := TarZip(spool, size, blob); err != nil {
+		return errors.Wrap(err, "Could not convert zip to tar")
+	}
+
+	return nil
+}